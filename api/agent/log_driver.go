@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"io"
+
+	"github.com/fnproject/fn/api/models"
+)
+
+// LogDriver is the extension point for shipping a function's stdout/stderr
+// somewhere structured, rather than letting it disappear once it has been
+// streamed back to the caller over the Engage connection. The pure runner
+// opens one writer per accepted TryCall and tees the call's output into it
+// alongside the response writer.
+//
+// This mirrors the plugin shape Docker uses for its logging drivers: a
+// small interface operators can implement against, wired in at
+// CreatePureRunner time rather than compiled into the agent package.
+type LogDriver interface {
+	// Open returns a writer that receives the stdout/stderr of call for as
+	// long as the call runs. The pure runner closes the returned writer once
+	// the call finishes.
+	Open(call *models.Call) (io.WriteCloser, error)
+	// Close releases any resources held by the driver itself (background
+	// flush goroutines, open files, network clients). The pure runner itself
+	// never calls it.
+	Close()
+}
+
+// nullLogDriver discards call output. It is the default when CreatePureRunner
+// is not given a LogDriver, so pure runners behave exactly as before this
+// subsystem existed.
+type nullLogDriver struct{}
+
+type nullLogWriter struct{}
+
+func (nullLogWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (nullLogWriter) Close() error                { return nil }
+
+func (nullLogDriver) Open(call *models.Call) (io.WriteCloser, error) {
+	return nullLogWriter{}, nil
+}
+
+func (nullLogDriver) Close() {}
+
+// NullLogDriver is a LogDriver that discards everything written to it.
+var NullLogDriver LogDriver = nullLogDriver{}
+
+// LogDriverFactory constructs a LogDriver, letting operators defer driver
+// setup (opening files, dialing a logging backend) until the pure runner is
+// actually being created.
+type LogDriverFactory func() (LogDriver, error)
+
+// WithLogDriver installs the LogDriver returned by factory on the pure
+// runner. Every accepted call's stdout/stderr is teed through it.
+func WithLogDriver(factory LogDriverFactory) PureRunnerOption {
+	return func(pr *pureRunner) error {
+		d, err := factory()
+		if err != nil {
+			return err
+		}
+		pr.logDriver = d
+		return nil
+	}
+}
@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/fnproject/fn/api/models"
+	"google.golang.org/api/option"
+)
+
+// gcpLogDriver ships call stdout/stderr to Google Cloud Logging
+// (Stackdriver). Entries are batched by the underlying logging.Logger and
+// flushed on a timer/size basis by the client library, labeled with the
+// app/function/call/runner identity so they can be filtered per-function in
+// the Cloud Console.
+type gcpLogDriver struct {
+	client        *logging.Client
+	logID         string
+	runnerAddress string
+}
+
+// NewGCPLogDriver returns a LogDriver that writes to the given Stackdriver
+// project, under logID, labeling every entry with runnerAddress so logs can
+// be traced back to the runner that produced them. opts are passed through
+// to the underlying Cloud Logging client (e.g. option.WithCredentialsFile).
+func NewGCPLogDriver(ctx context.Context, projectID, logID, runnerAddress string, opts ...option.ClientOption) (LogDriver, error) {
+	client, err := logging.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create stackdriver logging client: %v", err)
+	}
+	return &gcpLogDriver{client: client, logID: logID, runnerAddress: runnerAddress}, nil
+}
+
+func (d *gcpLogDriver) Open(call *models.Call) (io.WriteCloser, error) {
+	logger := d.client.Logger(d.logID, logging.CommonLabels(map[string]string{
+		"app_id":         call.AppID,
+		"fn_id":          call.FnID,
+		"call_id":        call.ID,
+		"runner_address": d.runnerAddress,
+	}))
+	return &gcpCallWriter{logger: logger, call: call}, nil
+}
+
+func (d *gcpLogDriver) Close() {
+	d.client.Close()
+}
+
+// gcpCallWriter batches individual Write calls into Stackdriver LogEntry
+// structs, stamped with the call's start time rather than the flush time so
+// log ordering survives the client library's async batching.
+type gcpCallWriter struct {
+	logger *logging.Logger
+	call   *models.Call
+}
+
+func (w *gcpCallWriter) Write(p []byte) (int, error) {
+	entry := logging.Entry{
+		Timestamp: time.Time(w.call.CreatedAt),
+		Severity:  logging.Info,
+		Payload:   string(p),
+	}
+	w.logger.Log(entry)
+	return len(p), nil
+}
+
+func (w *gcpCallWriter) Close() error {
+	return w.logger.Flush()
+}
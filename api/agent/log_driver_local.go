@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fnproject/fn/api/models"
+)
+
+// localJSONLogDriver writes each call's stdout/stderr as JSON-lines files
+// under dir, rotating the active file once it crosses maxBytes. Rotated
+// files are suffixed with a monotonically increasing generation number,
+// e.g. app-fn-call123.log, app-fn-call123.log.1, app-fn-call123.log.2, ...
+type localJSONLogDriver struct {
+	dir      string
+	maxBytes int64
+}
+
+// NewLocalJSONLogDriver returns a LogDriver that writes size-rotated
+// JSON-lines files under dir. A maxBytes of 0 disables rotation.
+func NewLocalJSONLogDriver(dir string, maxBytes int64) (LogDriver, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create log driver directory %s: %v", dir, err)
+	}
+	return &localJSONLogDriver{dir: dir, maxBytes: maxBytes}, nil
+}
+
+func (d *localJSONLogDriver) Open(call *models.Call) (io.WriteCloser, error) {
+	path := filepath.Join(d.dir, fmt.Sprintf("%s-%s-%s.log", call.AppID, call.FnID, call.ID))
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open log file %s: %v", path, err)
+	}
+	return &rotatingJSONWriter{
+		path:     path,
+		file:     f,
+		maxBytes: d.maxBytes,
+		call:     call,
+	}, nil
+}
+
+func (d *localJSONLogDriver) Close() {}
+
+// rotatingJSONWriter wraps the raw stdout/stderr bytes for a call in a JSON
+// line (one per Write) and rotates to a new generation of the file once
+// maxBytes is exceeded.
+type rotatingJSONWriter struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	written    int64
+	maxBytes   int64
+	generation int
+	call       *models.Call
+}
+
+type logLine struct {
+	Time string `json:"time"`
+	App  string `json:"app_id"`
+	Fn   string `json:"fn_id"`
+	Call string `json:"call_id"`
+	Data string `json:"data"`
+}
+
+func (w *rotatingJSONWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	line, err := json.Marshal(logLine{
+		Time: time.Now().UTC().Format(time.RFC3339Nano),
+		App:  w.call.AppID,
+		Fn:   w.call.FnID,
+		Call: w.call.ID,
+		Data: string(p),
+	})
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+
+	if _, err := w.file.Write(line); err != nil {
+		return 0, err
+	}
+	w.written += int64(len(line))
+
+	if w.maxBytes > 0 && w.written >= w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *rotatingJSONWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.generation++
+	if err := os.Rename(w.path, fmt.Sprintf("%s.%d", w.path, w.generation)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.written = 0
+	return nil
+}
+
+func (w *rotatingJSONWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
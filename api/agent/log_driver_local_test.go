@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fnproject/fn/api/models"
+)
+
+func TestRotatingJSONWriterRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fn-log-driver-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	driver, err := NewLocalJSONLogDriver(dir, 16)
+	if err != nil {
+		t.Fatalf("NewLocalJSONLogDriver: %v", err)
+	}
+
+	call := &models.Call{AppID: "app", FnID: "fn", ID: "call123"}
+	w, err := driver.Open(call)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	rw := w.(*rotatingJSONWriter)
+
+	// Each Write is well over maxBytes once JSON-encoded, so every one of
+	// these should trigger a rotation of the previous file.
+	for i := 0; i < 3; i++ {
+		if _, err := rw.Write([]byte("some call output")); err != nil {
+			t.Fatalf("Write #%d: %v", i, err)
+		}
+	}
+
+	if err := rw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if rw.generation != 3 {
+		t.Fatalf("expected 3 rotations, got generation=%d", rw.generation)
+	}
+	if rw.written != 0 {
+		t.Fatalf("expected the byte counter to reset after the last rotation, got %d", rw.written)
+	}
+
+	for gen := 1; gen <= 3; gen++ {
+		path := fmt.Sprintf("%s.%d", rw.path, gen)
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected rotated file %s to exist: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, filepath.Base(rw.path))); err != nil {
+		t.Fatalf("expected the active file to still exist after rotation: %v", err)
+	}
+}
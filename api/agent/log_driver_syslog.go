@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+
+	"github.com/fnproject/fn/api/models"
+)
+
+// syslogLogDriver ships each call's stdout/stderr to a syslog daemon, tagged
+// with the call's app/fn/call IDs so they can be correlated downstream.
+type syslogLogDriver struct {
+	network string
+	raddr   string
+}
+
+// NewSyslogLogDriver returns a LogDriver that writes to the syslog daemon at
+// raddr over network (e.g. "udp", "tcp"). An empty network/raddr dials the
+// local syslog daemon.
+func NewSyslogLogDriver(network, raddr string) LogDriver {
+	return &syslogLogDriver{network: network, raddr: raddr}
+}
+
+func (d *syslogLogDriver) Open(call *models.Call) (io.WriteCloser, error) {
+	tag := fmt.Sprintf("fn/%s/%s", call.AppID, call.FnID)
+	w, err := syslog.Dial(d.network, d.raddr, syslog.LOG_INFO|syslog.LOG_USER, tag)
+	if err != nil {
+		return nil, fmt.Errorf("could not dial syslog: %v", err)
+	}
+	return &syslogCallWriter{w: w, callID: call.ID}, nil
+}
+
+func (d *syslogLogDriver) Close() {}
+
+// syslogCallWriter prefixes every write with the call ID, since each call's
+// connection logs under the shared app/fn tag and lines from concurrent
+// calls of the same function are otherwise indistinguishable downstream.
+type syslogCallWriter struct {
+	w      *syslog.Writer
+	callID string
+}
+
+func (w *syslogCallWriter) Write(p []byte) (int, error) {
+	if err := w.w.Info(fmt.Sprintf("[%s] %s", w.callID, p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *syslogCallWriter) Close() error {
+	return w.w.Close()
+}
@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -20,16 +21,71 @@ import (
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
 )
 
+// Defaults for the gRPC keepalive enforcement between the pure runner and its
+// load balancers. The server pings a quiet connection every 10s and drops it
+// if the ping goes unanswered for another 10s, closes a connection that has
+// had no active stream for 2 minutes, and recycles every connection after
+// about 2 hours, so connections an LB has abandoned (e.g. after a pod
+// eviction) are reclaimed. MaxConnectionIdle only counts time with no active
+// stream, so a hot call sitting idle on an open Engage stream between data
+// frames is not cut off by it. The enforcement policy is looser than the gRPC
+// defaults: LBs may ping as often as every 5s, even with no active stream.
+const (
+	defaultMaxConnectionIdle     = 120 * time.Second
+	defaultMaxConnectionAge      = 2 * time.Hour
+	defaultMaxConnectionAgeGrace = 30 * time.Second
+	defaultKeepaliveTime         = 10 * time.Second
+	defaultKeepaliveTimeout      = 10 * time.Second
+
+	defaultKeepaliveMinTime             = 5 * time.Second
+	defaultKeepalivePermitWithoutStream = true
+)
+
+func defaultKeepaliveServerParams() keepalive.ServerParameters {
+	return keepalive.ServerParameters{
+		MaxConnectionIdle:     defaultMaxConnectionIdle,
+		MaxConnectionAge:      defaultMaxConnectionAge,
+		MaxConnectionAgeGrace: defaultMaxConnectionAgeGrace,
+		Time:                  defaultKeepaliveTime,
+		Timeout:               defaultKeepaliveTimeout,
+	}
+}
+
+func defaultKeepaliveEnforcementPolicy() keepalive.EnforcementPolicy {
+	return keepalive.EnforcementPolicy{
+		MinTime:             defaultKeepaliveMinTime,
+		PermitWithoutStream: defaultKeepalivePermitWithoutStream,
+	}
+}
+
 type pureRunner struct {
 	gRPCServer *grpc.Server
 	listen     string
 	a          Agent
 	inflight   int32
+
+	creds             credentials.TransportCredentials
+	serverParams      keepalive.ServerParameters
+	enforcementPolicy keepalive.EnforcementPolicy
+
+	unaryInterceptors  []grpc.UnaryServerInterceptor
+	streamInterceptors []grpc.StreamServerInterceptor
+	statsHandler       stats.Handler
+
+	logDriver LogDriver
+	metrics   PureRunnerMetrics
+
+	maxInflightBytes   int64
+	creditGrantTimeout time.Duration
 }
 
 type writerFacade struct {
@@ -37,6 +93,9 @@ type writerFacade struct {
 	outHeaders    http.Header
 	outStatus     int
 	headerWritten bool
+
+	sendMu sync.Mutex    // serializes engagement.Send, which multiple goroutines (Submit, Engage) call into
+	credit *creditWindow // bounds how much unacked response data we may have in flight
 }
 
 func (w *writerFacade) Header() http.Header {
@@ -48,6 +107,16 @@ func (w *writerFacade) WriteHeader(status int) {
 	w.commitHeaders()
 }
 
+// send serializes writes onto the Engage stream: engagement.Send is called
+// from the Submit goroutine (response data, CallFinished) as well as from
+// the Engage receive loop itself (CallAcknowledged, flow-control credit), and
+// a grpc.ServerStream's Send is not safe for concurrent use.
+func (w *writerFacade) send(msg *runner.RunnerMsg) error {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	return w.engagement.Send(msg)
+}
+
 func (w *writerFacade) commitHeaders() {
 	if w.headerWritten {
 		return
@@ -68,7 +137,7 @@ func (w *writerFacade) commitHeaders() {
 
 	logrus.Info("Sending call result start message")
 
-	err := w.engagement.Send(&runner.RunnerMsg{
+	err := w.send(&runner.RunnerMsg{
 		Body: &runner.RunnerMsg_ResultStart{
 			ResultStart: &runner.CallResultStart{
 				Meta: &runner.CallResultStart_Http{
@@ -88,28 +157,41 @@ func (w *writerFacade) commitHeaders() {
 	logrus.Info("Sent call result message")
 }
 
+// Write sends data to the caller in flow-controlled chunks, blocking until
+// the LB has granted enough credit to cover each chunk. This keeps a slow
+// consumer from pinning the goroutine (and the reserved slot) indefinitely:
+// if no credit arrives within the configured timeout, Write gives up with a
+// ResourceExhausted error instead of blocking forever.
 func (w *writerFacade) Write(data []byte) (int, error) {
-	logrus.Infof("Sending call response data %d bytes long", len(data))
 	w.commitHeaders()
-	err := w.engagement.Send(&runner.RunnerMsg{
-		Body: &runner.RunnerMsg_Data{
-			Data: &runner.DataFrame{
-				Data: data,
-				Eof:  false,
+	total := len(data)
+	for len(data) > 0 {
+		n, err := w.credit.acquire(len(data), maxFlowControlChunkBytes)
+		if err != nil {
+			return total - len(data), err
+		}
+		chunk := data[:n]
+		logrus.Infof("Sending call response data %d bytes long", len(chunk))
+		err = w.send(&runner.RunnerMsg{
+			Body: &runner.RunnerMsg_Data{
+				Data: &runner.DataFrame{
+					Data: chunk,
+					Eof:  false,
+				},
 			},
-		},
-	})
-
-	if err != nil {
-		return 0, fmt.Errorf("Error sending data: %v", err)
+		})
+		if err != nil {
+			return total - len(data), fmt.Errorf("Error sending data: %v", err)
+		}
+		data = data[n:]
 	}
-	return len(data), nil
+	return total, nil
 }
 
 func (w *writerFacade) Close() error {
 	logrus.Info("Sending call response data end")
 	w.commitHeaders()
-	err := w.engagement.Send(&runner.RunnerMsg{
+	err := w.send(&runner.RunnerMsg{
 		Body: &runner.RunnerMsg_Data{
 			Data: &runner.DataFrame{
 				Eof: true,
@@ -123,27 +205,87 @@ func (w *writerFacade) Close() error {
 	return nil
 }
 
+// teeResponseWriter tees everything written to the underlying
+// http.ResponseWriter into a LogDriver-provided writer as well, so a call's
+// stdout/stderr both streams back to the caller and lands in whatever
+// structured log sink is configured.
+type teeResponseWriter struct {
+	http.ResponseWriter
+	tee io.Writer
+}
+
+func (t *teeResponseWriter) Write(data []byte) (int, error) {
+	if _, err := t.tee.Write(data); err != nil {
+		logrus.WithError(err).Warn("log driver write failed")
+	}
+	return t.ResponseWriter.Write(data)
+}
+
 type callState struct {
+	// mu guards c and input, which are set once by handleTryCall but read
+	// both from the Engage receive loop and from the context-watcher
+	// goroutine started alongside it - without it, the watcher can observe a
+	// torn or stale read of either field while handleTryCall is writing them.
+	mu            sync.Mutex
 	c             *call // the agent's version of call
 	w             *writerFacade
 	input         io.WriteCloser
+	logWriter     io.WriteCloser // function stdout/stderr sink, from the pure runner's LogDriver
+	logWriterOnce sync.Once      // guards against closing logWriter from more than one of its three closers
 	started       bool
 	receivedTime  strfmt.DateTime // When was the call received?
 	allocatedTime strfmt.DateTime // When did we finish allocating the slot?
 	streamError   error           // Last communication error on the stream
 }
 
+// setCallAndInput records the call and its input pipe once slot allocation
+// has succeeded, under mu so concurrent readers (see callAndInput) never see
+// a partial update.
+func (s *callState) setCallAndInput(c *call, input io.WriteCloser) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.c = c
+	s.input = input
+}
+
+// callAndInput returns the call and its input pipe as set by setCallAndInput,
+// or nil, nil if no call has been allocated yet.
+func (s *callState) callAndInput() (*call, io.WriteCloser) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c, s.input
+}
+
+// closeLogWriter closes the call's log sink exactly once, however the call
+// ends: handleTryCall's GetCall-failure branch, handleData's Submit
+// goroutine, and Engage's own cleanup all need to close it depending on how
+// far the call got, and this lets all three call it unconditionally without
+// double-closing the underlying file/connection/client.
+func (s *callState) closeLogWriter() {
+	s.logWriterOnce.Do(func() {
+		if s.logWriter == nil {
+			return
+		}
+		if err := s.logWriter.Close(); err != nil {
+			logrus.WithError(err).Warn("failed to close log driver writer")
+		}
+	})
+}
+
 func (pr *pureRunner) handleData(ctx context.Context, data *runner.DataFrame, state *callState) error {
 	if !state.started {
 		state.started = true
 		go func() {
+			defer state.closeLogWriter()
 			err := pr.a.Submit(state.c)
 			if err != nil {
 				if state.streamError == nil { // If we can still write back...
-					err2 := state.w.engagement.Send(&runner.RunnerMsg{
+					classified := classifyCallError(ctx, err)
+					err2 := state.w.send(&runner.RunnerMsg{
 						Body: &runner.RunnerMsg_Finished{&runner.CallFinished{
 							Success: false,
-							Details: fmt.Sprintf("%v", err),
+							Code:    statusCode(classified),
+							Details: statusDetails(classified),
 						}}})
 					if err2 != nil {
 						state.streamError = err2
@@ -155,10 +297,12 @@ func (pr *pureRunner) handleData(ctx context.Context, data *runner.DataFrame, st
 			err = state.w.Close()
 			if err != nil {
 				if state.streamError == nil { // If we can still write back...
-					err2 := state.w.engagement.Send(&runner.RunnerMsg{
+					classified := classifyCallError(ctx, err)
+					err2 := state.w.send(&runner.RunnerMsg{
 						Body: &runner.RunnerMsg_Finished{&runner.CallFinished{
 							Success: false,
-							Details: fmt.Sprintf("%v", err),
+							Code:    statusCode(classified),
+							Details: statusDetails(classified),
 						}}})
 					if err2 != nil {
 						state.streamError = err2
@@ -167,9 +311,10 @@ func (pr *pureRunner) handleData(ctx context.Context, data *runner.DataFrame, st
 				return
 			}
 			if state.streamError == nil { // If we can still write back...
-				err2 := state.w.engagement.Send(&runner.RunnerMsg{
+				err2 := state.w.send(&runner.RunnerMsg{
 					Body: &runner.RunnerMsg_Finished{&runner.CallFinished{
 						Success: true,
+						Code:    int32(codes.OK),
 						Details: state.c.Model().ID,
 					}}})
 				if err2 != nil {
@@ -195,26 +340,51 @@ func (pr *pureRunner) handleTryCall(ctx context.Context, tc *runner.TryCall, sta
 	var c models.Call
 	err := json.Unmarshal([]byte(tc.ModelsCallJson), &c)
 	if err != nil {
-		return err
+		return ErrorInvalidCall(err)
 	}
 	// TODO Validation of the call
 
 	state.receivedTime = strfmt.DateTime(time.Now())
+
+	logWriter, err := pr.logDriver.Open(&c)
+	if err != nil {
+		return fmt.Errorf("could not open log driver for call: %v", err)
+	}
+	state.logWriter = logWriter
+
 	var w http.ResponseWriter
-	w = state.w
-	inR, inW := io.Pipe()
-	agent_call, err := pr.a.GetCall(FromModelAndInput(&c, inR), WithWriter(w), WithReservedSlot(ctx, nil))
+	w = &teeResponseWriter{ResponseWriter: state.w, tee: logWriter}
+
+	// A bounded pipe, rather than a plain io.Pipe, lets the LB get up to
+	// maxInflightBytes ahead of the container without either side blocking on
+	// every single chunk, and tells us when the agent's reader has drained
+	// enough of the backlog that we should advertise more credit upstream.
+	pipe := newBoundedPipe(pr.maxInflightBytes, pr.maxInflightBytes/4, func(freed int32) {
+		pr.grantCredit(state, freed)
+	})
+	agent_call, err := pr.a.GetCall(FromModelAndInput(&c, pipe), WithWriter(w), WithReservedSlot(ctx, nil))
 	if err != nil {
-		return err
+		state.closeLogWriter()
+		return ErrorReservingSlot(err)
 	}
-	state.c = agent_call.(*call)
-	state.input = inW
+	state.setCallAndInput(agent_call.(*call), pipe)
 	// We spent some time pre-reserving a slot in GetCall so note this down now
 	state.allocatedTime = strfmt.DateTime(time.Now())
 
 	return nil
 }
 
+// grantCredit advertises window more bytes of input credit to the peer,
+// letting it resume sending DataFrames once our backlog has drained enough.
+func (pr *pureRunner) grantCredit(state *callState, window int32) {
+	err := state.w.send(&runner.RunnerMsg{
+		Body: &runner.RunnerMsg_Credit{Credit: &runner.Credit{Window: window}},
+	})
+	if err != nil {
+		logrus.WithError(err).Warn("failed to send flow-control credit")
+	}
+}
+
 // Handles a client engagement
 func (pr *pureRunner) Engage(engagement runner.RunnerProtocol_EngageServer) error {
 	// Keep lightweight tabs on what this runner is doing: for draindown tests
@@ -238,12 +408,39 @@ func (pr *pureRunner) Engage(engagement runner.RunnerProtocol_EngageServer) erro
 			outHeaders:    make(http.Header),
 			outStatus:     200,
 			headerWritten: false,
+			credit:        newCreditWindow(pr.maxInflightBytes, pr.creditGrantTimeout),
 		},
 		started:     false,
 		streamError: nil,
 	}
+	defer state.w.credit.closeWindow()
+	// If the stream ends before a single ClientMsg_Data arrives - a client
+	// disconnect or the keepalive/GOAWAY watcher below tearing down the
+	// context right after a successful TryCall - handleData's Submit
+	// goroutine never starts and never gets a chance to close logWriter.
+	// closeLogWriter is idempotent, so this is a no-op on the normal path
+	// where that goroutine (or the GetCall-failure branch) already closed it.
+	defer state.closeLogWriter()
 
 	grpc.EnableTracing = false
+
+	// If the keepalive enforcement policy (or a client hangup) tears down the
+	// stream's context while we're mid-call, make sure the reserved slot and
+	// the inflight counter don't leak: release the pipe so the Submit
+	// goroutine started by handleData unblocks and returns.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-engagement.Context().Done():
+			if c, input := state.callAndInput(); c != nil && input != nil {
+				input.Close()
+			}
+			state.w.credit.closeWindow()
+		case <-done:
+		}
+	}()
+
 	logrus.Info("Entering engagement loop")
 	for {
 		msg, err := engagement.Recv()
@@ -254,10 +451,10 @@ func (pr *pureRunner) Engage(engagement runner.RunnerProtocol_EngageServer) erro
 			// container is not stuck in a state where it is still expecting
 			// half the input of the previous call. The error this will likely
 			// cause will then release the slot.
-			if state.c != nil && state.c.reservedSlot != nil {
-				state.input.Close()
+			if c, input := state.callAndInput(); c != nil && c.reservedSlot != nil {
+				input.Close()
 			}
-			return err
+			return classifyCallError(engagement.Context(), err)
 		}
 
 		switch body := msg.Body.(type) {
@@ -265,24 +462,29 @@ func (pr *pureRunner) Engage(engagement runner.RunnerProtocol_EngageServer) erro
 		case *runner.ClientMsg_Try:
 			err := pr.handleTryCall(engagement.Context(), body.Try, &state)
 			if err != nil {
+				classified := classifyCallError(engagement.Context(), err)
 				if state.streamError == nil { // If we can still write back...
-					err2 := engagement.Send(&runner.RunnerMsg{
+					err2 := state.w.send(&runner.RunnerMsg{
 						Body: &runner.RunnerMsg_Acknowledged{&runner.CallAcknowledged{
 							Committed: false,
-							Details:   fmt.Sprintf("%v", err),
+							Code:      statusCode(classified),
+							Details:   statusDetails(classified),
 						}}})
 					if err2 != nil {
 						state.streamError = err2
 					}
 				}
-				return err
+				return classified
 			} else {
+				allocationLatency := time.Time(state.allocatedTime).Sub(time.Time(state.receivedTime))
+				pr.metrics.ObserveSlotAllocationLatency(allocationLatency)
 				if state.streamError == nil { // If we can still write back...
-					err2 := engagement.Send(&runner.RunnerMsg{
+					err2 := state.w.send(&runner.RunnerMsg{
 						Body: &runner.RunnerMsg_Acknowledged{&runner.CallAcknowledged{
 							Committed:             true,
+							Code:                  int32(codes.OK),
 							Details:               state.c.Model().ID,
-							SlotAllocationLatency: time.Time(state.allocatedTime).Sub(time.Time(state.receivedTime)).String(),
+							SlotAllocationLatency: allocationLatency.String(),
 						}}})
 					if err2 != nil {
 						state.streamError = err2
@@ -295,11 +497,18 @@ func (pr *pureRunner) Engage(engagement runner.RunnerProtocol_EngageServer) erro
 			// TODO If it's the first one, actually start the call. Then stream into current call.
 			err := pr.handleData(engagement.Context(), body.Data, &state)
 			if err != nil {
-				// What do we do here?!?
-				return err
+				return classifyCallError(engagement.Context(), err)
 			}
+
+		case *runner.ClientMsg_Credit:
+			// The LB is granting us more room to send response data.
+			if body.Credit == nil {
+				return status.Errorf(codes.InvalidArgument, "credit message missing its Credit body")
+			}
+			state.w.credit.grant(body.Credit.Window)
+
 		default:
-			return fmt.Errorf("Unrecognized or unhandled message in receive loop")
+			return status.Errorf(codes.InvalidArgument, "unrecognized or unhandled message in receive loop")
 		}
 	}
 }
@@ -323,18 +532,18 @@ func (pr *pureRunner) Start() error {
 	return nil
 }
 
-func CreatePureRunner(addr string, a Agent, cert string, key string, ca string) (*pureRunner, error) {
-	if cert != "" && key != "" && ca != "" {
-		c, err := creds(cert, key, ca)
-		if err != nil {
-			logrus.WithField("runner_addr", addr).Warn("Failed to create credentials!")
-			return nil, err
-		}
-		return createPureRunner(addr, a, c)
+func CreatePureRunner(addr string, a Agent, cert string, key string, ca string, options ...PureRunnerOption) (*pureRunner, error) {
+	if cert == "" || key == "" || ca == "" {
+		logrus.Warn("Running pure runner in insecure mode!")
 	}
 
-	logrus.Warn("Running pure runner in insecure mode!")
-	return createPureRunner(addr, a, nil)
+	options = append([]PureRunnerOption{WithTLS(cert, key, ca)}, options...)
+	pr, err := createPureRunner(addr, a, options...)
+	if err != nil {
+		logrus.WithField("runner_addr", addr).Warn("Failed to create pure runner!")
+		return nil, err
+	}
+	return pr, nil
 }
 
 func creds(cert string, key string, ca string) (credentials.TransportCredentials, error) {
@@ -362,19 +571,48 @@ func creds(cert string, key string, ca string) (credentials.TransportCredentials
 	}), nil
 }
 
-func createPureRunner(addr string, a Agent, creds credentials.TransportCredentials) (*pureRunner, error) {
-	var srv *grpc.Server
-	if creds != nil {
-		srv = grpc.NewServer(grpc.Creds(creds))
-	} else {
-		srv = grpc.NewServer()
-	}
+func createPureRunner(addr string, a Agent, options ...PureRunnerOption) (*pureRunner, error) {
 	pr := &pureRunner{
-		gRPCServer: srv,
-		listen:     addr,
-		a:          a,
+		listen:            addr,
+		a:                 a,
+		serverParams:      defaultKeepaliveServerParams(),
+		enforcementPolicy: defaultKeepaliveEnforcementPolicy(),
+		logDriver:         NullLogDriver,
+		metrics:           noopPureRunnerMetrics{},
+
+		maxInflightBytes:   defaultMaxInflightBytes,
+		creditGrantTimeout: defaultCreditGrantTimeout,
 	}
 
+	for _, option := range options {
+		if err := option(pr); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveParams(pr.serverParams),
+		grpc.KeepaliveEnforcementPolicy(pr.enforcementPolicy),
+	}
+	if pr.creds != nil {
+		opts = append(opts, grpc.Creds(pr.creds))
+	}
+	// The recovery interceptor always runs first so a panic anywhere later in
+	// the chain - including in an operator-supplied interceptor - can't take
+	// down the whole gRPC server.
+	unaryInterceptors := append([]grpc.UnaryServerInterceptor{recoveryUnaryInterceptor()}, pr.unaryInterceptors...)
+	streamInterceptors := append([]grpc.StreamServerInterceptor{recoveryStreamInterceptor()}, pr.streamInterceptors...)
+	opts = append(opts,
+		grpc.UnaryInterceptor(chainUnaryInterceptors(unaryInterceptors)),
+		grpc.StreamInterceptor(chainStreamInterceptors(streamInterceptors)),
+	)
+	if pr.statsHandler != nil {
+		opts = append(opts, grpc.StatsHandler(pr.statsHandler))
+	}
+
+	srv := grpc.NewServer(opts...)
+	pr.gRPCServer = srv
+
 	runner.RegisterRunnerProtocolServer(srv, pr)
 	return pr, nil
 }
@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Defaults for the credit-based flow control between the pure runner and its
+// load balancer. A slow consumer on either side of the Engage stream used to
+// stall the whole connection - and with it the reserved slot - because
+// writerFacade.Write and handleData pushed data with no regard for whether
+// the peer was keeping up. These bound how much unacknowledged data either
+// direction may have in flight before it must wait for more credit.
+const (
+	defaultMaxInflightBytes   = 4 * 1024 * 1024
+	defaultLowWaterMark       = defaultMaxInflightBytes / 4
+	defaultCreditGrantTimeout = 30 * time.Second
+	maxFlowControlChunkBytes  = 32 * 1024
+)
+
+// creditWindow tracks how many bytes a sender is still allowed to transmit.
+// It starts with an initial grant so the first write doesn't have to wait on
+// a round trip, and every subsequent grant() call (driven by an incoming
+// ClientMsg_Credit) tops it back up. acquire blocks until there's credit to
+// spend, the window is closed, or - only while it is genuinely blocked
+// waiting - the peer has gone quiet for longer than the configured timeout,
+// at which point it's treated as a dead peer. A call that never has to wait
+// (credit is already available) never starts the dead-peer clock at all, so
+// a long-running hot call with no backpressure is never penalized just for
+// having been alive longer than the timeout.
+type creditWindow struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	available int64
+	closed    bool
+	timedOut  bool
+	timeout   time.Duration
+	timer     *time.Timer // armed only while a caller is actually blocked in acquire
+	timerGen  int         // invalidates a timer's fire after it has been disarmed
+}
+
+func newCreditWindow(initial int64, timeout time.Duration) *creditWindow {
+	cw := &creditWindow{available: initial, timeout: timeout}
+	cw.cond = sync.NewCond(&cw.mu)
+	return cw
+}
+
+// armTimer and disarmTimer must be called with cw.mu held.
+
+func (cw *creditWindow) armTimer() {
+	if cw.timer != nil {
+		return
+	}
+	cw.timerGen++
+	gen := cw.timerGen
+	cw.timer = time.AfterFunc(cw.timeout, func() { cw.onTimeout(gen) })
+}
+
+func (cw *creditWindow) disarmTimer() {
+	if cw.timer != nil {
+		cw.timer.Stop()
+		cw.timer = nil
+	}
+	cw.timerGen++ // a timer that already fired and is blocked on cw.mu is now stale
+}
+
+func (cw *creditWindow) onTimeout(gen int) {
+	cw.mu.Lock()
+	if cw.timerGen == gen {
+		cw.timedOut = true
+		cw.cond.Broadcast()
+	}
+	cw.mu.Unlock()
+}
+
+// grant adds n bytes of credit to the window, as reported by the peer via a
+// ClientMsg_Credit, and clears any dead-peer state - the peer just proved
+// it's still alive.
+func (cw *creditWindow) grant(n int32) {
+	cw.mu.Lock()
+	cw.available += int64(n)
+	cw.timedOut = false
+	cw.disarmTimer()
+	cw.cond.Broadcast()
+	cw.mu.Unlock()
+}
+
+// acquire blocks until up to want bytes (capped at maxChunk) of credit are
+// available and returns how many bytes the caller may now send. The
+// dead-peer timeout only runs while this call is actually waiting; it is
+// disarmed again as soon as acquire stops blocking, win or lose.
+func (cw *creditWindow) acquire(want, maxChunk int) (int, error) {
+	if want > maxChunk {
+		want = maxChunk
+	}
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	for cw.available <= 0 && !cw.closed && !cw.timedOut {
+		cw.armTimer()
+		cw.cond.Wait()
+	}
+	cw.disarmTimer()
+	if cw.closed {
+		return 0, newPureRunnerError(codes.Canceled, "stream closed while waiting for flow-control credit", nil)
+	}
+	if cw.timedOut {
+		return 0, newPureRunnerError(codes.ResourceExhausted, "peer did not grant flow-control credit in time", nil)
+	}
+	n := int64(want)
+	if n > cw.available {
+		n = cw.available
+	}
+	cw.available -= n
+	return int(n), nil
+}
+
+// closeWindow wakes up any blocked acquire so it returns instead of waiting
+// forever once the Engage stream has ended.
+func (cw *creditWindow) closeWindow() {
+	cw.mu.Lock()
+	cw.closed = true
+	cw.disarmTimer()
+	cw.cond.Broadcast()
+	cw.mu.Unlock()
+}
+
+// boundedPipe is a fixed-capacity, single-reader/single-writer pipe used as
+// the input side of the Engage stream in place of a plain io.Pipe. Unlike
+// io.Pipe, which synchronizes every Write directly with a Read, a bounded
+// pipe lets writes get ahead of reads up to capacity - and signals onDrain
+// once the backlog falls back below lowWater, which the caller uses to
+// advertise more credit to the LB. onDrain fires on the edge crossing back
+// below lowWater, not on every Read below it, and reports only the bytes
+// consumed since the last signal - not total headroom - so the LB's credit
+// window is topped up by what was actually freed instead of being
+// over-granted every time a reader drains a few bytes at a time.
+type boundedPipe struct {
+	mu            sync.Mutex
+	cond          *sync.Cond
+	buf           bytes.Buffer
+	capacity      int64
+	lowWater      int64
+	closed        bool
+	onDrain       func(freedBytes int32)
+	belowLowWater bool
+	consumed      int64
+}
+
+func newBoundedPipe(capacity, lowWater int64, onDrain func(freedBytes int32)) *boundedPipe {
+	p := &boundedPipe{capacity: capacity, lowWater: lowWater, onDrain: onDrain}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *boundedPipe) Write(data []byte) (int, error) {
+	total := len(data)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(data) > 0 {
+		for int64(p.buf.Len()) >= p.capacity && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			return total - len(data), io.ErrClosedPipe
+		}
+		free := p.capacity - int64(p.buf.Len())
+		n := int64(len(data))
+		if n > free {
+			n = free
+		}
+		p.buf.Write(data[:n])
+		data = data[n:]
+	}
+	if int64(p.buf.Len()) > p.lowWater {
+		// backlog built back up past lowWater; allow the next drain to signal again
+		p.belowLowWater = false
+	}
+	return total, nil
+}
+
+func (p *boundedPipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	for p.buf.Len() == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if p.buf.Len() == 0 && p.closed {
+		p.mu.Unlock()
+		return 0, io.EOF
+	}
+	n, _ := p.buf.Read(b)
+	p.cond.Broadcast() // space freed up, wake any blocked Write
+	p.consumed += int64(n)
+
+	var freed int32
+	needsDrainSignal := false
+	if p.onDrain != nil && !p.belowLowWater && int64(p.buf.Len()) <= p.lowWater {
+		p.belowLowWater = true
+		needsDrainSignal = true
+		freed = int32(p.consumed)
+		p.consumed = 0
+	}
+	p.mu.Unlock()
+
+	if needsDrainSignal {
+		p.onDrain(freed)
+	}
+	return n, nil
+}
+
+func (p *boundedPipe) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *boundedPipe) Buffered() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return int64(p.buf.Len())
+}
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreditWindowAcquireDoesNotWaitWithAvailableCredit(t *testing.T) {
+	cw := newCreditWindow(10, 10*time.Millisecond)
+
+	n, err := cw.acquire(4, maxFlowControlChunkBytes)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("acquire returned %d, want 4", n)
+	}
+
+	// The timeout above is short enough that if a timer had been armed at
+	// construction time (rather than only while genuinely blocked), a second
+	// acquire well past that window would spuriously see timedOut.
+	time.Sleep(30 * time.Millisecond)
+
+	n, err = cw.acquire(4, maxFlowControlChunkBytes)
+	if err != nil {
+		t.Fatalf("acquire after sleeping past the timeout: %v", err)
+	}
+	if n != 4 {
+		t.Fatalf("acquire returned %d, want 4", n)
+	}
+}
+
+func TestCreditWindowAcquireTimesOutWhenBlocked(t *testing.T) {
+	cw := newCreditWindow(0, 10*time.Millisecond)
+
+	_, err := cw.acquire(1, maxFlowControlChunkBytes)
+	if err == nil {
+		t.Fatal("expected acquire to time out waiting for credit, got nil error")
+	}
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Fatalf("expected codes.ResourceExhausted, got %v", code)
+	}
+}
+
+func TestCreditWindowGrantUnblocksAndClearsTimeout(t *testing.T) {
+	cw := newCreditWindow(0, 10*time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := cw.acquire(1, maxFlowControlChunkBytes)
+		if err != nil {
+			t.Errorf("acquire: %v", err)
+		}
+		if n != 1 {
+			t.Errorf("acquire returned %d, want 1", n)
+		}
+	}()
+
+	time.Sleep(2 * time.Millisecond)
+	cw.grant(1)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("acquire did not unblock after grant")
+	}
+}
+
+func TestCreditWindowCloseUnblocksAcquire(t *testing.T) {
+	cw := newCreditWindow(0, time.Second)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cw.acquire(1, maxFlowControlChunkBytes)
+		done <- err
+	}()
+
+	time.Sleep(2 * time.Millisecond)
+	cw.closeWindow()
+
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Canceled {
+			t.Fatalf("expected codes.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire did not unblock after closeWindow")
+	}
+}
+
+func TestBoundedPipeDrainIsEdgeTriggeredWithAccumulatedBytes(t *testing.T) {
+	var drains []int32
+	p := newBoundedPipe(10, 5, func(freed int32) {
+		drains = append(drains, freed)
+	})
+
+	if _, err := p.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	buf := make([]byte, 1)
+	// Reading one byte at a time keeps buf.Len() above lowWater until the
+	// fifth read (10 -> 5), so onDrain must not fire before then, and must
+	// fire exactly once for the edge crossing.
+	for i := 0; i < 5; i++ {
+		if _, err := p.Read(buf); err != nil {
+			t.Fatalf("Read #%d: %v", i, err)
+		}
+	}
+	if len(drains) != 1 {
+		t.Fatalf("expected exactly 1 drain signal crossing lowWater, got %d: %v", len(drains), drains)
+	}
+	if drains[0] != 5 {
+		t.Fatalf("expected the drain signal to report the 5 bytes actually consumed, got %d", drains[0])
+	}
+
+	// Further reads stay below lowWater and must not re-signal.
+	if _, err := p.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(drains) != 1 {
+		t.Fatalf("expected no additional drain signal while staying below lowWater, got %d: %v", len(drains), drains)
+	}
+
+	// Writing back above lowWater re-arms the edge so the next crossing
+	// signals again.
+	if _, err := p.Write([]byte("abcde")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := p.Read(buf); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if len(drains) != 2 {
+		t.Fatalf("expected a second drain signal after refilling past lowWater, got %d: %v", len(drains), drains)
+	}
+}
+
+func TestBoundedPipeCloseUnblocksReadWithEOF(t *testing.T) {
+	p := newBoundedPipe(10, 5, nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	time.Sleep(2 * time.Millisecond)
+	p.Close()
+
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Fatalf("expected io.EOF, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read did not unblock after Close")
+	}
+}
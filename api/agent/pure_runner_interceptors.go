@@ -0,0 +1,240 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// NewCNAuthInterceptor builds a stream interceptor that rejects any call
+// whose client mTLS certificate's Common Name is not in allowedCNs. It is
+// meant to guard Engage, which otherwise trusts any peer the TLS handshake
+// accepted.
+func NewCNAuthInterceptor(allowedCNs ...string) grpc.StreamServerInterceptor {
+	allowed := make(map[string]bool, len(allowedCNs))
+	for _, cn := range allowedCNs {
+		allowed[cn] = true
+	}
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		cn, err := peerCommonName(ss.Context())
+		if err != nil {
+			return status.Errorf(codes.Unauthenticated, "could not determine peer identity: %v", err)
+		}
+		if !allowed[cn] {
+			logrus.WithField("cn", cn).Warn("Rejecting engagement from unauthorized peer")
+			return status.Errorf(codes.PermissionDenied, "peer %q is not authorized to call %s", cn, info.FullMethod)
+		}
+		return handler(srv, ss)
+	}
+}
+
+func peerCommonName(ctx context.Context) (string, error) {
+	pr, ok := peer.FromContext(ctx)
+	if !ok || pr.AuthInfo == nil {
+		return "", status.Error(codes.Unauthenticated, "no peer TLS info on the connection")
+	}
+	tlsInfo, ok := pr.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "peer did not present a TLS certificate")
+	}
+	certs := tlsInfo.State.PeerCertificates
+	if len(certs) == 0 {
+		return "", status.Error(codes.Unauthenticated, "peer did not present a client certificate")
+	}
+	return certs[0].Subject.CommonName, nil
+}
+
+// recoveryUnaryInterceptor and recoveryStreamInterceptor turn a panic
+// anywhere in the handler chain into a codes.Internal error instead of
+// letting it crash the whole gRPC server process - one misbehaving call (or
+// a bug in a later interceptor) should not take down every other in-flight
+// Engage stream on the runner. They are always installed first in the
+// chain, ahead of any operator-supplied interceptors, so nothing runs
+// unprotected.
+func recoveryUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				logrus.WithField("method", info.FullMethod).Errorf("recovered from panic in unary handler: %v", r)
+				err = status.Errorf(codes.Internal, "internal error")
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+func recoveryStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				logrus.WithField("method", info.FullMethod).Errorf("recovered from panic in stream handler: %v", r)
+				err = status.Errorf(codes.Internal, "internal error")
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+// engageTracingHandler is a grpc/stats.Handler that starts an OpenTracing
+// span for each RPC the server handles (Engage and Status alike) and tags it
+// with the RPC's begin and end times and, on failure, its gRPC code. The
+// call's receivedTime/allocatedTime are not attached to the span.
+type engageTracingHandler struct {
+	tracer opentracing.Tracer
+}
+
+// NewTracingStatsHandler returns a stats.Handler that reports one span per
+// RPC to the given tracer, pulling the span context out of incoming gRPC
+// metadata when the caller propagated one.
+func NewTracingStatsHandler(tracer opentracing.Tracer) stats.Handler {
+	return &engageTracingHandler{tracer: tracer}
+}
+
+type tracingSpanKey struct{}
+
+func (h *engageTracingHandler) TagRPC(ctx context.Context, tag *stats.RPCTagInfo) context.Context {
+	spanCtx, _ := h.tracer.Extract(opentracing.TextMap, metadataTextMapCarrier(ctx))
+	span := h.tracer.StartSpan(tag.FullMethodName, opentracing.ChildOf(spanCtx))
+	return context.WithValue(ctx, tracingSpanKey{}, span)
+}
+
+func (h *engageTracingHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	span, ok := ctx.Value(tracingSpanKey{}).(opentracing.Span)
+	if !ok {
+		return
+	}
+	switch rs := s.(type) {
+	case *stats.Begin:
+		// These are the gRPC stream's begin/end times, not the call's
+		// receivedTime/allocatedTime (which handleTryCall tracks separately
+		// and reports via SlotAllocationLatency) - tag them as generic RPC
+		// timestamps so they aren't mistaken for slot-allocation timings.
+		span.SetTag("rpc.beginTime", rs.BeginTime)
+	case *stats.End:
+		span.SetTag("rpc.endTime", rs.EndTime)
+		if rs.Error != nil {
+			span.SetTag("error", true)
+			span.SetTag("grpc.code", status.Code(rs.Error).String())
+		}
+		span.Finish()
+	}
+}
+
+func (h *engageTracingHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *engageTracingHandler) HandleConn(ctx context.Context, _ stats.ConnStats) {}
+
+// metadataTextMapCarrier adapts the incoming gRPC metadata on ctx to an
+// opentracing.TextMapReader so span contexts propagated by the load balancer
+// can be picked back up here.
+func metadataTextMapCarrier(ctx context.Context) opentracing.TextMapReader {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return opentracing.TextMapCarrier(flattenMetadata(md))
+}
+
+func flattenMetadata(md metadata.MD) map[string]string {
+	flat := make(map[string]string, len(md))
+	for k, vals := range md {
+		if len(vals) > 0 {
+			flat[k] = vals[0]
+		}
+	}
+	return flat
+}
+
+// Prometheus metrics for the pure runner's gRPC surface. Registered once at
+// package init so multiple pureRunners in the same process share one set of
+// series, consistent with how other fn components export metrics.
+var (
+	promInflight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "fn",
+		Subsystem: "pure_runner",
+		Name:      "inflight_calls",
+		Help:      "Number of Engage calls currently being served by this pure runner.",
+	})
+	promSlotAllocationLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "fn",
+		Subsystem: "pure_runner",
+		Name:      "slot_allocation_latency_seconds",
+		Help:      "Time spent reserving a container slot for a call.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	promCallDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "fn",
+		Subsystem: "pure_runner",
+		Name:      "call_duration_seconds",
+		Help:      "Duration of an Engage RPC from start to termination.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	promTerminationsByCode = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "fn",
+		Subsystem: "pure_runner",
+		Name:      "call_terminations_total",
+		Help:      "Number of Engage RPCs terminated, labeled by grpc status code.",
+	}, []string{"code"})
+)
+
+func init() {
+	prometheus.MustRegister(promInflight, promSlotAllocationLatency, promCallDuration, promTerminationsByCode)
+}
+
+// NewPrometheusStreamInterceptor builds a stream interceptor exporting
+// inflight/duration/termination-code metrics for Engage. Slot-allocation
+// latency is reported separately, through the PureRunnerMetrics installed
+// via WithMetrics, once Engage knows the allocatedTime/receivedTime for the
+// call.
+func NewPrometheusStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		promInflight.Inc()
+		defer promInflight.Dec()
+
+		start := time.Now()
+		err := handler(srv, ss)
+		promCallDuration.Observe(time.Since(start).Seconds())
+		promTerminationsByCode.WithLabelValues(status.Code(err).String()).Inc()
+		return err
+	}
+}
+
+// PureRunnerMetrics abstracts the call-level metrics Engage reports as it
+// processes a call, so the agent package doesn't hardcode a dependency on
+// Prometheus - an operator who wants a different backend (or none) can
+// supply their own implementation via WithMetrics.
+type PureRunnerMetrics interface {
+	// ObserveSlotAllocationLatency reports how long a TryCall spent waiting
+	// for handleTryCall to reserve a container slot.
+	ObserveSlotAllocationLatency(d time.Duration)
+}
+
+// noopPureRunnerMetrics is the default PureRunnerMetrics used when no
+// WithMetrics option is supplied.
+type noopPureRunnerMetrics struct{}
+
+func (noopPureRunnerMetrics) ObserveSlotAllocationLatency(time.Duration) {}
+
+// prometheusPureRunnerMetrics reports call-level metrics to the package's
+// Prometheus series.
+type prometheusPureRunnerMetrics struct{}
+
+func (prometheusPureRunnerMetrics) ObserveSlotAllocationLatency(d time.Duration) {
+	promSlotAllocationLatency.Observe(d.Seconds())
+}
+
+// NewPrometheusMetrics returns a PureRunnerMetrics that reports to this
+// package's Prometheus series, for use with WithMetrics.
+func NewPrometheusMetrics() PureRunnerMetrics {
+	return prometheusPureRunnerMetrics{}
+}
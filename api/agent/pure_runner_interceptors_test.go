@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func contextWithPeerCN(cn string) context.Context {
+	var authInfo credentials.AuthInfo
+	if cn != "" {
+		authInfo = credentials.TLSInfo{
+			State: tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{
+					{Subject: pkix.Name{CommonName: cn}},
+				},
+			},
+		}
+	}
+	return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: authInfo})
+}
+
+func TestPeerCommonName(t *testing.T) {
+	cn, err := peerCommonName(contextWithPeerCN("runner-1"))
+	if err != nil {
+		t.Fatalf("peerCommonName: %v", err)
+	}
+	if cn != "runner-1" {
+		t.Fatalf("peerCommonName() = %q, want %q", cn, "runner-1")
+	}
+}
+
+func TestPeerCommonNameNoPeer(t *testing.T) {
+	if _, err := peerCommonName(context.Background()); err == nil {
+		t.Fatal("expected an error with no peer on the context")
+	}
+}
+
+func TestPeerCommonNameNoCertificate(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{}})
+	if _, err := peerCommonName(ctx); err == nil {
+		t.Fatal("expected an error when the peer presented no certificate")
+	}
+}
+
+func TestNewCNAuthInterceptorAllowsAllowedCN(t *testing.T) {
+	interceptor := NewCNAuthInterceptor("runner-1", "runner-2")
+	ss := &fakeServerStream{ctx: contextWithPeerCN("runner-2")}
+	called := false
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		called = true
+		return nil
+	}
+	if err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: "/Engage"}, handler); err != nil {
+		t.Fatalf("interceptor rejected an allow-listed CN: %v", err)
+	}
+	if !called {
+		t.Fatal("handler was not invoked for an allow-listed CN")
+	}
+}
+
+func TestNewCNAuthInterceptorRejectsUnknownCN(t *testing.T) {
+	interceptor := NewCNAuthInterceptor("runner-1")
+	ss := &fakeServerStream{ctx: contextWithPeerCN("intruder")}
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		t.Fatal("handler should not run for a non-allow-listed CN")
+		return nil
+	}
+	err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: "/Engage"}, handler)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected codes.PermissionDenied, got %v", err)
+	}
+}
+
+func TestRecoveryUnaryInterceptorRecoversPanic(t *testing.T) {
+	interceptor := recoveryUnaryInterceptor()
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	}
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/Status"}, handler)
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("expected codes.Internal after recovering a panic, got %v", err)
+	}
+}
+
+func TestRecoveryStreamInterceptorRecoversPanic(t *testing.T) {
+	interceptor := recoveryStreamInterceptor()
+	ss := &fakeServerStream{ctx: context.Background()}
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		panic("boom")
+	}
+	err := interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: "/Engage"}, handler)
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("expected codes.Internal after recovering a panic, got %v", err)
+	}
+}
+
+// fakeServerStream implements grpc.ServerStream with just enough behavior
+// (a Context) to drive the interceptors under test.
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (f *fakeServerStream) Context() context.Context { return f.ctx }
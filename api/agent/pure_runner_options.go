@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/stats"
+)
+
+// PureRunnerOption configures a pureRunner at construction time. Operators
+// compose these to plug cross-cutting concerns (auth, tracing, metrics) into
+// the gRPC server without the agent package needing to know about any
+// particular observability stack.
+type PureRunnerOption func(*pureRunner) error
+
+// WithTLS configures the pure runner to require mTLS using the given
+// certificate, key and CA bundle, mirroring the behavior CreatePureRunner
+// has always provided via its cert/key/ca arguments: any of the three left
+// blank falls back to insecure mode, the same as passing none of them.
+func WithTLS(cert, key, ca string) PureRunnerOption {
+	return func(pr *pureRunner) error {
+		if cert == "" || key == "" || ca == "" {
+			return nil
+		}
+		c, err := creds(cert, key, ca)
+		if err != nil {
+			return err
+		}
+		pr.creds = c
+		return nil
+	}
+}
+
+// WithKeepalive overrides the default gRPC keepalive enforcement. See
+// defaultKeepaliveServerParams/defaultKeepaliveEnforcementPolicy for the
+// values applied when this option is not supplied.
+func WithKeepalive(params keepalive.ServerParameters, policy keepalive.EnforcementPolicy) PureRunnerOption {
+	return func(pr *pureRunner) error {
+		pr.serverParams = params
+		pr.enforcementPolicy = policy
+		return nil
+	}
+}
+
+// WithUnaryInterceptor appends a unary server interceptor to the chain run
+// for every unary RPC (currently only Status).
+func WithUnaryInterceptor(i grpc.UnaryServerInterceptor) PureRunnerOption {
+	return func(pr *pureRunner) error {
+		pr.unaryInterceptors = append(pr.unaryInterceptors, i)
+		return nil
+	}
+}
+
+// WithStreamInterceptor appends a stream server interceptor to the chain run
+// for every streaming RPC (currently only Engage).
+func WithStreamInterceptor(i grpc.StreamServerInterceptor) PureRunnerOption {
+	return func(pr *pureRunner) error {
+		pr.streamInterceptors = append(pr.streamInterceptors, i)
+		return nil
+	}
+}
+
+// WithStatsHandler installs a grpc/stats.Handler, e.g. to export per-RPC
+// tracing spans or connection-level metrics.
+func WithStatsHandler(h stats.Handler) PureRunnerOption {
+	return func(pr *pureRunner) error {
+		pr.statsHandler = h
+		return nil
+	}
+}
+
+// WithFlowControl overrides the per-stream credit-based flow control limits:
+// maxInflightBytes bounds how much unacknowledged data either direction of
+// an Engage stream may have outstanding, and creditGrantTimeout is how long
+// a sender will wait for the peer to grant more credit before giving up on
+// it as unresponsive.
+func WithFlowControl(maxInflightBytes int64, creditGrantTimeout time.Duration) PureRunnerOption {
+	return func(pr *pureRunner) error {
+		pr.maxInflightBytes = maxInflightBytes
+		pr.creditGrantTimeout = creditGrantTimeout
+		return nil
+	}
+}
+
+// WithMetrics installs a PureRunnerMetrics implementation that Engage
+// reports call-level metrics (e.g. slot-allocation latency) to, in place of
+// the no-op default.
+func WithMetrics(m PureRunnerMetrics) PureRunnerOption {
+	return func(pr *pureRunner) error {
+		pr.metrics = m
+		return nil
+	}
+}
+
+// chainUnaryInterceptors composes a slice of interceptors into a single one,
+// invoking them in order and passing each one's handler as the next one's.
+func chainUnaryInterceptors(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor := interceptors[i]
+			next := chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
+
+// chainStreamInterceptors composes a slice of stream interceptors into a
+// single one, invoking them in order and passing each one's handler as the
+// next one's.
+func chainStreamInterceptors(interceptors []grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor := interceptors[i]
+			next := chained
+			chained = func(srv interface{}, ss grpc.ServerStream) error {
+				return interceptor(srv, ss, info, next)
+			}
+		}
+		return chained(srv, ss)
+	}
+}
@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrCallOOMKilled is the sentinel a container execution path wraps its
+// error in to report that a call's container was killed by the OOM killer,
+// so classifyCallError can turn it into ErrorContainerOOM instead of the
+// generic codes.Internal fallback.
+var ErrCallOOMKilled = errors.New("container was killed by the oom killer")
+
+// Sentinel errors returned by the pure runner's call-handling path. Wrapping
+// an underlying error in one of these lets statusCode classify it without
+// resorting to string matching on its message.
+type pureRunnerError struct {
+	code codes.Code
+	msg  string
+	err  error
+}
+
+func (e *pureRunnerError) Error() string {
+	if e.err != nil {
+		return e.msg + ": " + e.err.Error()
+	}
+	return e.msg
+}
+
+func (e *pureRunnerError) Unwrap() error {
+	return e.err
+}
+
+func (e *pureRunnerError) GRPCStatus() *status.Status {
+	return status.New(e.code, e.Error())
+}
+
+func newPureRunnerError(code codes.Code, msg string, err error) error {
+	return &pureRunnerError{code: code, msg: msg, err: err}
+}
+
+var (
+	// ErrorReservingSlot is returned when the agent could not reserve a
+	// container slot for the call (queue full, capacity exhausted).
+	ErrorReservingSlot = func(err error) error {
+		return newPureRunnerError(codes.ResourceExhausted, "failed to reserve a slot", err)
+	}
+	// ErrorContainerOOM is returned when the call's container was killed by
+	// the OOM killer while the call was executing.
+	ErrorContainerOOM = func(err error) error {
+		return newPureRunnerError(codes.ResourceExhausted, "container ran out of memory", err)
+	}
+	// ErrorCallTimedOut is returned when the user's function exceeded its
+	// configured timeout.
+	ErrorCallTimedOut = func(err error) error {
+		return newPureRunnerError(codes.DeadlineExceeded, "call timed out", err)
+	}
+	// ErrorInvalidCall is returned when the TryCall payload could not be
+	// decoded into a valid models.Call.
+	ErrorInvalidCall = func(err error) error {
+		return newPureRunnerError(codes.InvalidArgument, "invalid call", err)
+	}
+	// ErrorBackpressure is returned when the runner is shedding load and
+	// asking the caller to retry elsewhere.
+	ErrorBackpressure = func(err error) error {
+		return newPureRunnerError(codes.Unavailable, "runner is overloaded", err)
+	}
+	// ErrorStreamCancelled is returned when the Engage stream was cancelled
+	// (or its input pipe closed) while a call was in flight. A stream whose
+	// deadline was exceeded is reported as ErrorCallTimedOut instead.
+	ErrorStreamCancelled = func(err error) error {
+		return newPureRunnerError(codes.Canceled, "engagement stream was cancelled", err)
+	}
+)
+
+// classifyCallError maps an error surfaced by the agent's call-handling path
+// (slot reservation, container execution, stream I/O) to the grpc.Status it
+// should be reported as, so that pool managers can drive retry/backoff
+// policies off of codes.Code rather than matching against Details strings.
+func classifyCallError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if pre, ok := err.(*pureRunnerError); ok {
+		return pre
+	}
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unknown {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, ErrCallOOMKilled):
+		return ErrorContainerOOM(err)
+	case err == context.DeadlineExceeded:
+		return ErrorCallTimedOut(err)
+	case err == context.Canceled, err == io.ErrClosedPipe:
+		return ErrorStreamCancelled(err)
+	case ctx.Err() == context.Canceled:
+		return ErrorStreamCancelled(err)
+	case ctx.Err() == context.DeadlineExceeded:
+		return ErrorCallTimedOut(err)
+	default:
+		return newPureRunnerError(codes.Internal, "call failed", err)
+	}
+}
+
+// statusDetails renders the human-readable message for err's classified
+// status. The canonical code itself is carried separately by statusCode, so
+// pool managers can drive retry/backoff logic off of the Code field instead
+// of parsing it back out of this string.
+func statusDetails(err error) string {
+	s, _ := status.FromError(classifyCallError(context.Background(), err))
+	return s.Message()
+}
+
+// statusCode returns the canonical grpc.Code for err's classified status, for
+// the CallAcknowledged/CallFinished Code field.
+func statusCode(err error) int32 {
+	s, _ := status.FromError(classifyCallError(context.Background(), err))
+	return int32(s.Code())
+}
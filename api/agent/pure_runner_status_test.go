@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyCallError(t *testing.T) {
+	cases := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want codes.Code
+	}{
+		{"nil error", context.Background(), nil, codes.OK},
+		{"already a pureRunnerError", context.Background(), ErrorContainerOOM(errors.New("oom")), codes.ResourceExhausted},
+		{"existing grpc status is preserved", context.Background(), status.Error(codes.AlreadyExists, "dup"), codes.AlreadyExists},
+		{"bare oom sentinel is classified as container oom", context.Background(), ErrCallOOMKilled, codes.ResourceExhausted},
+		{"wrapped oom sentinel is classified as container oom", context.Background(), fmt.Errorf("container exited: %w", ErrCallOOMKilled), codes.ResourceExhausted},
+		{"context deadline exceeded error", context.Background(), context.DeadlineExceeded, codes.DeadlineExceeded},
+		{"context canceled error", context.Background(), context.Canceled, codes.Canceled},
+		{"closed pipe is treated as a cancellation", context.Background(), io.ErrClosedPipe, codes.Canceled},
+		{"ctx itself timed out", canceledContext(context.DeadlineExceeded), errors.New("boom"), codes.DeadlineExceeded},
+		{"ctx itself was canceled", canceledContext(context.Canceled), errors.New("boom"), codes.Canceled},
+		{"unrecognized error maps to internal", context.Background(), errors.New("boom"), codes.Internal},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.err == nil {
+				if got := classifyCallError(tc.ctx, tc.err); got != nil {
+					t.Fatalf("expected nil, got %v", got)
+				}
+				return
+			}
+			got := classifyCallError(tc.ctx, tc.err)
+			if code := status.Code(got); code != tc.want {
+				t.Fatalf("expected code %v, got %v (%v)", tc.want, code, got)
+			}
+		})
+	}
+}
+
+func TestStatusCodeAndDetails(t *testing.T) {
+	err := ErrorCallTimedOut(errors.New("took too long"))
+
+	if got, want := statusCode(err), int32(codes.DeadlineExceeded); got != want {
+		t.Fatalf("statusCode() = %d, want %d", got, want)
+	}
+	if details := statusDetails(err); details == "" {
+		t.Fatal("statusDetails() returned an empty message")
+	}
+}
+
+// canceledContext returns a context whose Err() already reports reason,
+// without needing the caller to wire up real cancellation plumbing.
+func canceledContext(reason error) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	if reason == context.DeadlineExceeded {
+		var dcancel context.CancelFunc
+		ctx, dcancel = context.WithTimeout(context.Background(), 0)
+		_ = dcancel
+		return ctx
+	}
+	cancel()
+	return ctx
+}
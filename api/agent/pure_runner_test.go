@@ -0,0 +1,50 @@
+package agent
+
+import "testing"
+
+type countingWriteCloser struct {
+	closes int
+}
+
+func (c *countingWriteCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (c *countingWriteCloser) Close() error {
+	c.closes++
+	return nil
+}
+
+func TestCallStateCloseLogWriterIsIdempotent(t *testing.T) {
+	lw := &countingWriteCloser{}
+	state := &callState{logWriter: lw}
+
+	state.closeLogWriter()
+	state.closeLogWriter()
+	state.closeLogWriter()
+
+	if lw.closes != 1 {
+		t.Fatalf("expected logWriter to be closed exactly once across all callers, got %d", lw.closes)
+	}
+}
+
+func TestCallStateCloseLogWriterNilIsSafe(t *testing.T) {
+	state := &callState{}
+	state.closeLogWriter() // must not panic when no call ever reserved a slot
+}
+
+func TestWithTLSFallsBackToInsecureOnPartialArgs(t *testing.T) {
+	cases := [][3]string{
+		{"", "", ""},
+		{"cert.pem", "", ""},
+		{"", "key.pem", ""},
+		{"", "", "ca.pem"},
+		{"cert.pem", "key.pem", ""},
+	}
+	for _, c := range cases {
+		pr := &pureRunner{}
+		if err := WithTLS(c[0], c[1], c[2])(pr); err != nil {
+			t.Fatalf("WithTLS(%q, %q, %q) = %v, want insecure no-op", c[0], c[1], c[2], err)
+		}
+		if pr.creds != nil {
+			t.Fatalf("WithTLS(%q, %q, %q) set creds, want insecure no-op", c[0], c[1], c[2])
+		}
+	}
+}